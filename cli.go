@@ -13,6 +13,12 @@ import (
 
 // initCLI initializes CLI mode.
 func initCLI(c *cli.Context) error {
+	// Optional sidecar /metrics listener, since CLI mode runs no HTTP
+	// server of its own.
+	if addr := c.String("metrics-address"); addr != "" {
+		go serveMetrics(addr)
+	}
+
 	// Start workers.
 	var (
 		num  = c.Int("workers")
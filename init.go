@@ -8,6 +8,7 @@ import (
 	"log"
 
 	"github.com/knadh/pfxsigner/internal/processor"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/unidoc/unipdf/v3/model"
 	"github.com/urfave/cli"
 )
@@ -31,10 +32,31 @@ func initApp(f cli.ActionFunc) cli.ActionFunc {
 
 		// Initialize global workers.
 		proc = processor.New(pr, logger)
+		proc.SetMetrics(newPromMetrics(prometheus.DefaultRegisterer))
 
-		// Load the PFX.
-		if err := proc.LoadPFX(c.GlobalString("pfx-file"), c.GlobalString("pfx-password")); err != nil {
-			log.Fatalf("error loading PFX: %v", err)
+		// Load the "default" key, either from an HSM via PKCS#11 if
+		// --pkcs11-module is set, or from the PFX file otherwise.
+		if mod := c.GlobalString("pkcs11-module"); mod != "" {
+			ks := &processor.PKCS11KeySource{
+				ModulePath: mod,
+				Slot:       c.GlobalUint("pkcs11-slot"),
+				Label:      c.GlobalString("pkcs11-label"),
+				ID:         c.GlobalString("pkcs11-id"),
+				PIN:        c.GlobalString("pkcs11-pin"),
+			}
+			if err := proc.LoadKey("default", ks); err != nil {
+				log.Fatalf("error loading PKCS#11 key: %v", err)
+			}
+		} else {
+			if err := proc.LoadPFX("default", c.GlobalString("pfx-file"), c.GlobalString("pfx-password")); err != nil {
+				log.Fatalf("error loading PFX: %v", err)
+			}
+		}
+
+		// Load any additional named keys registered in the `keys` section
+		// of the props file.
+		if err := proc.LoadKeys(pr.Keys); err != nil {
+			log.Fatalf("error loading keys: %v", err)
 		}
 
 		return f(c)
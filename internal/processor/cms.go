@@ -0,0 +1,238 @@
+package processor
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/gunnsth/pkcs7"
+)
+
+// cmsAttribute is a CMS/PKCS#7 Attribute (RFC 2315 9.2): a SET containing a
+// single DER-encoded value, addressed by its Type OID.
+type cmsAttribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type cmsIssuerAndSerial struct {
+	IssuerName   asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type cmsSignerInfo struct {
+	Version                   int `asn1:"default:1"`
+	IssuerAndSerialNumber     cmsIssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   []cmsAttribute `asn1:"optional,set,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes []cmsAttribute `asn1:"optional,set,tag:1"`
+}
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type cmsSignedData struct {
+	Version                    int                        `asn1:"default:1"`
+	DigestAlgorithmIdentifiers []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo                cmsContentInfo
+	Certificates               asn1.RawValue   `asn1:"optional,tag:0"`
+	SignerInfos                []cmsSignerInfo `asn1:"set"`
+}
+
+// cmsSigner builds a detached CMS (PKCS#7) SignedData with a single signer,
+// accepting any crypto.Signer rather than a concrete *rsa.PrivateKey.
+//
+// This exists because github.com/gunnsth/pkcs7's AddSigner/AddSignerChain
+// selects the SignerInfo's digestEncryptionAlgorithm by switching on the
+// concrete private key type, so it rejects signers backed by an external key
+// store such as a PKCS#11 HSM even though they fully implement
+// crypto.Signer. cmsSigner resolves that OID from the signer's public key
+// instead, so it works uniformly for PFX-loaded RSA keys and HSM-backed
+// keys alike.
+type cmsSigner struct {
+	hash      crypto.Hash
+	hashOID   asn1.ObjectIdentifier
+	certs     []*x509.Certificate
+	signerInf cmsSignerInfo
+}
+
+// newCMSSigner signs content (the detached payload) with signer/cert and
+// returns a cmsSigner ready to be finalized. chain, if any, is included in
+// the SignedData's certificate set but not used to derive the signature.
+func newCMSSigner(content []byte, signer crypto.Signer, cert *x509.Certificate, chain []*x509.Certificate, hashAlgo string) (*cmsSigner, error) {
+	hash, hashOID, err := tsaHashOID(hashAlgo)
+	if err != nil {
+		return nil, err
+	}
+	encOID, err := encryptionOIDForSigner(signer, hashOID)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write(content)
+	contentDigest := h.Sum(nil)
+
+	authAttrs := []cmsAttribute{
+		newCMSAttribute(pkcs7.OIDAttributeContentType, pkcs7.OIDData),
+		newCMSAttribute(pkcs7.OIDAttributeMessageDigest, contentDigest),
+		newCMSAttribute(pkcs7.OIDAttributeSigningTime, time.Now()),
+	}
+
+	signedAttrBytes, err := derSetOfContent(authAttrs)
+	if err != nil {
+		return nil, err
+	}
+	h = hash.New()
+	h.Write(signedAttrBytes)
+	sig, err := signer.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return nil, fmt.Errorf("error signing CMS attributes: %v", err)
+	}
+
+	certs := make([]*x509.Certificate, 0, len(chain)+1)
+	certs = append(certs, cert)
+	certs = append(certs, chain...)
+
+	return &cmsSigner{
+		hash:    hash,
+		hashOID: hashOID,
+		certs:   certs,
+		signerInf: cmsSignerInfo{
+			Version: 1,
+			IssuerAndSerialNumber: cmsIssuerAndSerial{
+				IssuerName:   asn1.RawValue{FullBytes: cert.RawIssuer},
+				SerialNumber: cert.SerialNumber,
+			},
+			DigestAlgorithm:           pkix.AlgorithmIdentifier{Algorithm: hashOID},
+			AuthenticatedAttributes:   authAttrs,
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: encOID},
+			EncryptedDigest:           sig,
+		},
+	}, nil
+}
+
+// EncryptedDigest returns the signature value of the SignerInfo, eg: to be
+// used as the input of an RFC 3161 timestamp request.
+func (s *cmsSigner) EncryptedDigest() []byte {
+	return s.signerInf.EncryptedDigest
+}
+
+// SetUnauthenticatedAttribute attaches a single unsigned attribute (such as
+// an RFC 3161 id-aa-timeStampToken) to the SignerInfo.
+func (s *cmsSigner) SetUnauthenticatedAttribute(oid asn1.ObjectIdentifier, der asn1.RawValue) {
+	s.signerInf.UnauthenticatedAttributes = []cmsAttribute{{Type: oid, Value: der}}
+}
+
+// Finish marshals the detached CMS SignedData.
+func (s *cmsSigner) Finish() ([]byte, error) {
+	var rawCerts asn1.RawValue
+	if len(s.certs) > 0 {
+		rawCerts = marshalCMSCertificates(s.certs)
+	}
+
+	sd := cmsSignedData{
+		Version:                    1,
+		DigestAlgorithmIdentifiers: []pkix.AlgorithmIdentifier{{Algorithm: s.hashOID}},
+		ContentInfo:                cmsContentInfo{ContentType: pkcs7.OIDData},
+		Certificates:               rawCerts,
+		SignerInfos:                []cmsSignerInfo{s.signerInf},
+	}
+	inner, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+
+	outer := cmsContentInfo{
+		ContentType: pkcs7.OIDSignedData,
+		Content:     asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: inner},
+	}
+	return asn1.Marshal(outer)
+}
+
+// newCMSAttribute DER-encodes value and wraps it as a CMS Attribute's
+// single-element SET value.
+func newCMSAttribute(oid asn1.ObjectIdentifier, value interface{}) cmsAttribute {
+	der, err := asn1.Marshal(value)
+	if err != nil {
+		// value is always one of a small set of known-marshalable types
+		// (an OID, a byte slice or a time.Time), so this can't happen.
+		panic(fmt.Sprintf("cms: error encoding attribute %v: %v", oid, err))
+	}
+	return cmsAttribute{
+		Type:  oid,
+		Value: asn1.RawValue{Class: 0, Tag: 17, IsCompound: true, Bytes: der}, // 17 == SET
+	}
+}
+
+// derSetOfContent DER-encodes attrs as a `SET OF Attribute` (sorted per
+// X.690 11.6) and returns that SET's full encoding, its universal SET tag
+// and length included (only the wrapper SEQUENCE used to marshal it is
+// stripped), matching what RFC 2315 requires signers to hash when
+// producing the signature over authenticated attributes.
+func derSetOfContent(attrs []cmsAttribute) ([]byte, error) {
+	encoded, err := asn1.Marshal(struct {
+		A []cmsAttribute `asn1:"set"`
+	}{A: attrs})
+	if err != nil {
+		return nil, err
+	}
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(encoded, &raw); err != nil {
+		return nil, err
+	}
+	return raw.Bytes, nil
+}
+
+// marshalCMSCertificates DER-encodes certs as the SignedData.certificates
+// [0] IMPLICIT field.
+func marshalCMSCertificates(certs []*x509.Certificate) asn1.RawValue {
+	var buf []byte
+	for _, c := range certs {
+		buf = append(buf, c.Raw...)
+	}
+	return asn1.RawValue{Class: 2, Tag: 0, IsCompound: true, Bytes: buf}
+}
+
+// encryptionOIDForSigner resolves the CMS digestEncryptionAlgorithm OID for
+// a crypto.Signer based on its public key algorithm, rather than its
+// concrete private key type (see cmsSigner).
+func encryptionOIDForSigner(signer crypto.Signer, hashOID asn1.ObjectIdentifier) (asn1.ObjectIdentifier, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		switch {
+		case hashOID.Equal(pkcs7.OIDDigestAlgorithmSHA1):
+			return pkcs7.OIDEncryptionAlgorithmRSASHA1, nil
+		case hashOID.Equal(pkcs7.OIDDigestAlgorithmSHA384):
+			return pkcs7.OIDEncryptionAlgorithmRSASHA384, nil
+		case hashOID.Equal(pkcs7.OIDDigestAlgorithmSHA512):
+			return pkcs7.OIDEncryptionAlgorithmRSASHA512, nil
+		default:
+			return pkcs7.OIDEncryptionAlgorithmRSASHA256, nil
+		}
+	case *ecdsa.PublicKey:
+		switch {
+		case hashOID.Equal(pkcs7.OIDDigestAlgorithmSHA1):
+			return pkcs7.OIDDigestAlgorithmECDSASHA1, nil
+		case hashOID.Equal(pkcs7.OIDDigestAlgorithmSHA384):
+			return pkcs7.OIDDigestAlgorithmECDSASHA384, nil
+		case hashOID.Equal(pkcs7.OIDDigestAlgorithmSHA512):
+			return pkcs7.OIDDigestAlgorithmECDSASHA512, nil
+		default:
+			return pkcs7.OIDDigestAlgorithmECDSASHA256, nil
+		}
+	default:
+		return nil, fmt.Errorf("cms: unsupported signer public key type %T", signer.Public())
+	}
+}
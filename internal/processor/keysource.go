@@ -0,0 +1,45 @@
+package processor
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// PFXKeySource loads a signing certificate and the crypto.Signer bound to
+// its private key from an on-disk PFX (PKCS#12) file. It implements
+// KeySource.
+type PFXKeySource struct {
+	Path     string
+	Password string
+}
+
+// Load reads and decodes the PFX file.
+func (k *PFXKeySource) Load() (*Certificate, error) {
+	pfxData, err := ioutil.ReadFile(k.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	priv, cert, chain, err := pkcs12.DecodeChain(pfxData, k.Password)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding PFX '%s': %v", k.Path, err)
+	}
+
+	// encryptionOIDForSigner (cms.go) resolves the CMS digest encryption
+	// algorithm from the signer's public key, so RSA and ECDSA keys both
+	// work here. Other key types (eg: Ed25519) load, but signing with them
+	// fails with an unsupported key type error.
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("pfx: private key type %T does not implement crypto.Signer", priv)
+	}
+
+	return &Certificate{
+		Signer: signer,
+		Cert:   cert,
+		Chain:  chain,
+	}, nil
+}
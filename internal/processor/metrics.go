@@ -0,0 +1,43 @@
+package processor
+
+import "time"
+
+// Metrics is the set of runtime instrumentation hooks Processor and its
+// helpers publish to. Implementations must be safe for concurrent use, since
+// Listen runs multiple worker goroutines and the HTTP server handles
+// requests concurrently.
+type Metrics interface {
+	// ObserveSign records the outcome and wall-clock duration of signing a
+	// single document with cert.
+	ObserveSign(cert, outcome string, dur time.Duration)
+
+	// ObservePDFBytes records the size, in bytes, of the input and signed
+	// output PDF for a document signed with cert.
+	ObservePDFBytes(cert string, in, out int)
+
+	// ObserveTSARequest records the outcome and duration of a single RFC
+	// 3161 timestamp request.
+	ObserveTSARequest(outcome string, dur time.Duration)
+
+	// SetQueueDepth reports the number of jobs currently queued for
+	// Listen's workers: CLI mode's stdin queue, or the HTTP server's async
+	// job queue.
+	SetQueueDepth(n int)
+}
+
+// NopMetrics is a Metrics implementation that discards everything. It is the
+// default used by New, so callers that don't care about instrumentation
+// (and tests) don't need to supply one.
+type NopMetrics struct{}
+
+// ObserveSign implements Metrics.
+func (NopMetrics) ObserveSign(cert, outcome string, dur time.Duration) {}
+
+// ObservePDFBytes implements Metrics.
+func (NopMetrics) ObservePDFBytes(cert string, in, out int) {}
+
+// ObserveTSARequest implements Metrics.
+func (NopMetrics) ObserveTSARequest(outcome string, dur time.Duration) {}
+
+// SetQueueDepth implements Metrics.
+func (NopMetrics) SetQueueDepth(n int) {}
@@ -0,0 +1,276 @@
+package processor
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11DigestInfoPrefixes holds the DER DigestInfo prefixes (RFC 3447,
+// Section 9.2, Note 1) that CKM_RSA_PKCS expects to be prepended to the
+// raw hash before signing, since the mechanism itself performs no hashing.
+var pkcs11DigestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// PKCS11KeySource loads a signing certificate and a crypto.Signer bound to
+// its private key from a PKCS#11 token (an HSM or a software token), so the
+// private key never has to be read into process memory. It implements
+// KeySource.
+type PKCS11KeySource struct {
+	// ModulePath is the path to the PKCS#11 provider's shared library.
+	ModulePath string
+
+	// Slot selects which token slot to open.
+	Slot uint
+
+	// Label and ID identify the key pair and certificate on the token via
+	// CKA_LABEL / CKA_ID. At least one of them must be set.
+	Label string
+	ID    string
+
+	PIN string
+}
+
+// Load opens the PKCS#11 token, logs in and resolves the signing
+// certificate and a crypto.Signer bound to its private key handle.
+func (k *PKCS11KeySource) Load() (*Certificate, error) {
+	if k.ModulePath == "" {
+		return nil, errors.New("pkcs11: module path is required")
+	}
+	if k.Label == "" && k.ID == "" {
+		return nil, errors.New("pkcs11: a label or id is required to find the signing key")
+	}
+
+	ctx := pkcs11.New(k.ModulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("pkcs11: could not load module '%s'", k.ModulePath)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("pkcs11: error initializing module '%s': %v", k.ModulePath, err)
+	}
+
+	session, err := ctx.OpenSession(k.Slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, fmt.Errorf("pkcs11: error opening session on slot %d: %v", k.Slot, err)
+	}
+
+	if err := ctx.Login(session, pkcs11.CKU_USER, k.PIN); err != nil {
+		ctx.CloseSession(session)
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, fmt.Errorf("pkcs11: error logging in to slot %d: %v", k.Slot, err)
+	}
+
+	cert, err := findPKCS11Certificate(ctx, session, k.Label, k.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	privHandle, err := findPKCS11Object(ctx, session, pkcs11.CKO_PRIVATE_KEY, k.Label, k.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cert.PublicKey.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("pkcs11: unsupported public key type %T, only RSA and ECDSA are supported", cert.PublicKey)
+	}
+
+	chain, err := findPKCS11Chain(ctx, session, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Certificate{
+		Signer: &pkcs11Signer{ctx: ctx, session: session, handle: privHandle, public: cert.PublicKey},
+		Cert:   cert,
+		Chain:  chain,
+	}, nil
+}
+
+// findPKCS11Object finds the single object of the given class matching
+// label and/or id.
+func findPKCS11Object(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, class uint, label, id string) (pkcs11.ObjectHandle, error) {
+	tmpl := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+	if label != "" {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
+	}
+	if id != "" {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(id)))
+	}
+
+	if err := ctx.FindObjectsInit(session, tmpl); err != nil {
+		return 0, fmt.Errorf("pkcs11: FindObjectsInit failed: %v", err)
+	}
+	defer ctx.FindObjectsFinal(session)
+
+	objs, _, err := ctx.FindObjects(session, 1)
+	if err != nil {
+		return 0, fmt.Errorf("pkcs11: FindObjects failed: %v", err)
+	}
+	if len(objs) == 0 {
+		return 0, fmt.Errorf("pkcs11: no object of class %d found for label='%s' id='%s'", class, label, id)
+	}
+	return objs[0], nil
+}
+
+// findPKCS11Certificate finds a CKO_CERTIFICATE object matching label and/or
+// id and parses its CKA_VALUE as an X.509 certificate.
+func findPKCS11Certificate(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, label, id string) (*x509.Certificate, error) {
+	handle, err := findPKCS11Object(ctx, session, pkcs11.CKO_CERTIFICATE, label, id)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: error reading certificate value: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(attrs[0].Value)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: error parsing certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// findPKCS11Chain walks the issuer chain for leaf by repeatedly resolving a
+// CKO_CERTIFICATE object on the token whose CKA_SUBJECT matches the current
+// certificate's issuer, the way HSMs that hold a full chain typically store
+// it. It stops at a self-signed (root) certificate, or as soon as an issuer
+// isn't found on the token: the rest of the chain is then expected to come
+// from the verifier's own trust store, same as for a PFX-loaded key whose
+// PKCS#12 container didn't include the full chain.
+func findPKCS11Chain(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, leaf *x509.Certificate) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+
+	cur := leaf
+	for i := 0; i < 10; i++ { // guards against a misconfigured token looping issuer -> subject.
+		if bytes.Equal(cur.RawIssuer, cur.RawSubject) {
+			break
+		}
+		next, err := findPKCS11CertificateBySubject(ctx, session, cur.RawIssuer)
+		if err != nil {
+			break
+		}
+		chain = append(chain, next)
+		cur = next
+	}
+
+	return chain, nil
+}
+
+// findPKCS11CertificateBySubject finds a CKO_CERTIFICATE object whose
+// CKA_SUBJECT matches rawSubject and parses its CKA_VALUE as an X.509
+// certificate.
+func findPKCS11CertificateBySubject(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, rawSubject []byte) (*x509.Certificate, error) {
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_SUBJECT, rawSubject),
+	}
+	if err := ctx.FindObjectsInit(session, tmpl); err != nil {
+		return nil, fmt.Errorf("pkcs11: FindObjectsInit failed: %v", err)
+	}
+	defer ctx.FindObjectsFinal(session)
+
+	objs, _, err := ctx.FindObjects(session, 1)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: FindObjects failed: %v", err)
+	}
+	if len(objs) == 0 {
+		return nil, errors.New("pkcs11: no certificate found for issuer subject")
+	}
+
+	attrs, err := ctx.GetAttributeValue(session, objs[0], []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: error reading certificate value: %v", err)
+	}
+	return x509.ParseCertificate(attrs[0].Value)
+}
+
+// pkcs11Signer implements crypto.Signer over an RSA or ECDSA key handle held
+// on a PKCS#11 token. The private key material never leaves the token.
+type pkcs11Signer struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	handle  pkcs11.ObjectHandle
+	public  crypto.PublicKey
+}
+
+// Public returns the signer's public key.
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs digest (already hashed by opts.HashFunc()) using the token's
+// private key: RSASSA-PKCS1-v1_5 for an RSA key, CKM_ECDSA for an ECDSA key.
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	switch pub := s.public.(type) {
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, errors.New("pkcs11: RSA-PSS is not supported, only PKCS#1 v1.5")
+		}
+
+		prefix, ok := pkcs11DigestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("pkcs11: unsupported hash algorithm %v", opts.HashFunc())
+		}
+		digestInfo := append(append([]byte{}, prefix...), digest...)
+
+		if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}, s.handle); err != nil {
+			return nil, fmt.Errorf("pkcs11: SignInit failed: %v", err)
+		}
+		return s.ctx.Sign(s.session, digestInfo)
+
+	case *ecdsa.PublicKey:
+		if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, s.handle); err != nil {
+			return nil, fmt.Errorf("pkcs11: SignInit failed: %v", err)
+		}
+		raw, err := s.ctx.Sign(s.session, digest)
+		if err != nil {
+			return nil, fmt.Errorf("pkcs11: Sign failed: %v", err)
+		}
+		return ecdsaRawSignatureToASN1(raw, pub.Curve)
+
+	default:
+		return nil, fmt.Errorf("pkcs11: unsupported public key type %T", s.public)
+	}
+}
+
+// ecdsaRawSignatureToASN1 converts the raw r||s signature CKM_ECDSA returns
+// into the ASN.1 DER (R, S) sequence crypto.Signer implementations for
+// ECDSA are expected to produce (as crypto/ecdsa.Sign does).
+func ecdsaRawSignatureToASN1(raw []byte, curve elliptic.Curve) ([]byte, error) {
+	n := (curve.Params().BitSize + 7) / 8
+	if len(raw) != 2*n {
+		return nil, fmt.Errorf("pkcs11: unexpected ECDSA signature length %d, want %d", len(raw), 2*n)
+	}
+
+	sig := struct{ R, S *big.Int }{
+		R: new(big.Int).SetBytes(raw[:n]),
+		S: new(big.Int).SetBytes(raw[n:]),
+	}
+	return asn1.Marshal(sig)
+}
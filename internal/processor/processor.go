@@ -2,7 +2,7 @@ package processor
 
 import (
 	"bytes"
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 	"errors"
 	"fmt"
@@ -17,8 +17,6 @@ import (
 	"github.com/unidoc/unipdf/v3/core"
 	"github.com/unidoc/unipdf/v3/core/security"
 	"github.com/unidoc/unipdf/v3/model"
-	"github.com/unidoc/unipdf/v3/model/sighandler"
-	"software.sslmate.com/src/go-pkcs12"
 )
 
 // SignStyle holds signature field styles.
@@ -46,6 +44,30 @@ type SignCoords struct {
 	Y2    float64 `json:"y2"`
 }
 
+// TimestampProps holds the configuration required to obtain an RFC 3161
+// timestamp token from a TSA (Time Stamping Authority) and embed it in a
+// signature, producing a PAdES-B-T signature.
+type TimestampProps struct {
+	Enabled  bool   `json:"enabled"`
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// HashAlgo is the digest algorithm to use for the message imprint sent
+	// to the TSA: sha1, sha256 (default), sha384 or sha512.
+	HashAlgo string `json:"hashAlgo"`
+
+	// PolicyOID optionally requests a specific TSA policy, eg: "1.2.3.4.5".
+	PolicyOID string `json:"policyOID"`
+
+	// Timeout is the HTTP request timeout, in seconds. Defaults to 30.
+	Timeout int `json:"timeout"`
+
+	// Retries is the number of additional attempts made if the TSA request
+	// fails or times out. Defaults to 2.
+	Retries int `json:"retries"`
+}
+
 // SignProps represents signature properties that are required to do
 // sign a document.
 type SignProps struct {
@@ -56,6 +78,52 @@ type SignProps struct {
 	Annotations []map[string]string `json:"annotations"`
 	Style       SignStyle           `json:"style"`
 	Coords      []SignCoords        `json:"coords"`
+
+	// Timestamp, when enabled, embeds an RFC 3161 timestamp token from the
+	// configured TSA as an unsigned attribute on the CMS signature.
+	Timestamp TimestampProps `json:"timestamp"`
+
+	// Keys registers additional named signing keys (PFX or PKCS#11) beyond
+	// the "default" one loaded from the CLI flags.
+	Keys []KeyConfig `json:"keys"`
+}
+
+// KeyConfig describes a named signing key to load at startup, backed by
+// either an on-disk PFX file or a PKCS#11 token.
+type KeyConfig struct {
+	Name string `json:"name"`
+
+	// Type selects the backend: "pfx" (default) or "pkcs11".
+	Type string `json:"type"`
+
+	// PFX backend.
+	Path     string `json:"path"`
+	Password string `json:"password"`
+
+	// PKCS#11 backend.
+	ModulePath string `json:"modulePath"`
+	Slot       uint   `json:"slot"`
+	Label      string `json:"label"`
+	ID         string `json:"id"`
+	PIN        string `json:"pin"`
+}
+
+// keySource builds the KeySource described by the config.
+func (k KeyConfig) keySource() (KeySource, error) {
+	switch k.Type {
+	case "", "pfx":
+		return &PFXKeySource{Path: k.Path, Password: k.Password}, nil
+	case "pkcs11":
+		return &PKCS11KeySource{
+			ModulePath: k.ModulePath,
+			Slot:       k.Slot,
+			Label:      k.Label,
+			ID:         k.ID,
+			PIN:        k.PIN,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown key type '%s' for key '%s'", k.Type, k.Name)
+	}
 }
 
 // Job represents a queued doc sign job. This is used in bulk processing
@@ -65,6 +133,21 @@ type Job struct {
 	InFile   string
 	OutFile  string
 	Password []byte
+
+	// Props overrides the processor's default signature properties for
+	// this job, if set. CLI mode jobs read from stdin leave it nil and
+	// get the default props loaded from props.json.
+	Props *SignProps
+
+	// Started, if set, is invoked by Listen right before the job starts
+	// processing. Used by the HTTP server's async job API to mark a
+	// queued job as running; CLI mode leaves it nil.
+	Started func()
+
+	// Done, if set, is invoked by Listen after the job finishes, with the
+	// resulting error (nil on success). Used by the HTTP server's async
+	// job API to record completion; CLI mode leaves it nil.
+	Done func(err error)
 }
 
 // Stats represents docsign job stats.
@@ -81,16 +164,30 @@ type Processor struct {
 	// PFX that's loaded.
 	certs map[string]*Certificate
 
-	stats  Stats
-	mut    sync.Mutex
-	logger *log.Logger
+	stats   Stats
+	mut     sync.Mutex
+	logger  *log.Logger
+	metrics Metrics
 }
 
-// Certificate represents a x509 certificate and its key loaded
-// from a PFX.
+// Certificate represents a x509 certificate and a signer bound to its
+// private key, loaded from a KeySource.
 type Certificate struct {
-	PrivKey *rsa.PrivateKey
-	Cert    *x509.Certificate
+	Signer crypto.Signer
+	Cert   *x509.Certificate
+
+	// Chain holds the intermediate (and root, if present) certificates
+	// accompanying Cert, as returned by the KeySource. It is embedded in
+	// the CMS SignedData's certificate set.
+	Chain []*x509.Certificate
+}
+
+// KeySource abstracts loading a signing certificate and the crypto.Signer
+// bound to its private key. PFXKeySource loads both from an on-disk PFX
+// file; PKCS11KeySource resolves them from a PKCS#11 token (an HSM) instead,
+// so the private key never needs to be read into process memory.
+type KeySource interface {
+	Load() (*Certificate, error)
 }
 
 // New returns a new instance of Processor.
@@ -102,14 +199,26 @@ func New(def SignProps, l *log.Logger) *Processor {
 		stats: Stats{
 			StartTime: time.Now(),
 		},
-		logger: l,
+		logger:  l,
+		metrics: NopMetrics{},
 	}
 }
 
+// SetMetrics registers m to receive runtime instrumentation. If never
+// called, Processor reports to a NopMetrics that discards everything.
+func (p *Processor) SetMetrics(m Metrics) {
+	p.metrics = m
+}
+
 // Listen starts a listener that consumes PDF file names in fileQ
 // signs them.
 func (p *Processor) Listen(q chan Job) {
 	for j := range q {
+		p.metrics.SetQueueDepth(len(q))
+		if j.Started != nil {
+			j.Started()
+		}
+
 		// Pre-increment the fail counter because there are multiple
 		// failure exits.
 		p.mut.Lock()
@@ -120,19 +229,33 @@ func (p *Processor) Listen(q chan Job) {
 		f, err := os.Open(j.InFile)
 		if err != nil {
 			p.logger.Printf("error reading file %s: %v", j.InFile, err)
+			if j.Done != nil {
+				j.Done(err)
+			}
 			continue
 		}
 		defer f.Close()
 
-		out, err := p.ProcessDoc(j.CertName, p.props, j.Password, f)
+		pr := p.props
+		if j.Props != nil {
+			pr = *j.Props
+		}
+
+		out, err := p.ProcessDoc(j.CertName, pr, j.Password, f)
 		if err != nil {
 			p.logger.Printf("error processing to sign PDF %s: %v", j.InFile, err)
+			if j.Done != nil {
+				j.Done(err)
+			}
 			continue
 		}
 
 		// Write the output to a file.
 		if err := ioutil.WriteFile(j.OutFile, out, 0644); err != nil {
 			p.logger.Printf("error writing PDF %s to %s", j.InFile, j.OutFile)
+			if j.Done != nil {
+				j.Done(err)
+			}
 			continue
 		}
 
@@ -143,6 +266,10 @@ func (p *Processor) Listen(q chan Job) {
 		total := p.stats.JobsDone + p.stats.JobsFailed
 		p.mut.Unlock()
 
+		if j.Done != nil {
+			j.Done(nil)
+		}
+
 		if total%1000 == 0 {
 			p.logger.Println(total)
 		}
@@ -152,13 +279,25 @@ func (p *Processor) Listen(q chan Job) {
 
 // ProcessDoc takes a document and signs it (with optional password protection).
 func (p *Processor) ProcessDoc(certName string, pr SignProps, password []byte, b io.ReadSeeker) ([]byte, error) {
+	start := time.Now()
+
+	inSize, err := b.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, errors.New("error reading input PDF")
+	}
+	if _, err := b.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.New("error reading input PDF")
+	}
+
 	cert, ok := p.certs[certName]
 	if !ok {
+		p.metrics.ObserveSign(certName, "error", time.Since(start))
 		return nil, fmt.Errorf("unknown certificate '%s'", certName)
 	}
 	rd, err := model.NewPdfReader(b)
 	if err != nil {
 		p.logger.Printf("error opening PDF reader: %v", err)
+		p.metrics.ObserveSign(certName, "error", time.Since(start))
 		return nil, errors.New("error opening PDF")
 	}
 
@@ -168,6 +307,7 @@ func (p *Processor) ProcessDoc(certName string, pr SignProps, password []byte, b
 		b, err := p.lockPDF(rd, password)
 		if err != nil {
 			p.logger.Printf("error locking PDF with password: %v", err)
+			p.metrics.ObserveSign(certName, "error", time.Since(start))
 			return nil, errors.New("error locking PDF with password")
 		}
 
@@ -175,10 +315,12 @@ func (p *Processor) ProcessDoc(certName string, pr SignProps, password []byte, b
 		r, err := model.NewPdfReader(b)
 		if err != nil {
 			p.logger.Printf("error re-opening PDF after locking: %v", err)
+			p.metrics.ObserveSign(certName, "error", time.Since(start))
 			return nil, errors.New("error re-opening PDF after locking")
 		}
 		if ok, err := r.Decrypt(password); !ok || err != nil {
 			p.logger.Printf("error re-reading PDF after locking: %v", err)
+			p.metrics.ObserveSign(certName, "error", time.Since(start))
 			return nil, errors.New("error re-reading PDF after locking")
 		}
 		rd = r
@@ -188,12 +330,16 @@ func (p *Processor) ProcessDoc(certName string, pr SignProps, password []byte, b
 	ap, err := p.signPDF(cert, pr, rd)
 	if err != nil {
 		p.logger.Printf("error signing PDF after locking: %v", err)
+		p.metrics.ObserveSign(certName, "error", time.Since(start))
 		return nil, errors.New("error signing PDF after locking")
 	}
 
 	// Get the signed PDF buffer.
 	out := bytes.NewBuffer(nil)
 	ap.Write(out)
+
+	p.metrics.ObserveSign(certName, "signed", time.Since(start))
+	p.metrics.ObservePDFBytes(certName, int(inSize), out.Len())
 	return out.Bytes(), nil
 }
 
@@ -211,23 +357,38 @@ func (p *Processor) GetProps() SignProps {
 
 // LoadPFX loads a PFX key and certificate.
 func (p *Processor) LoadPFX(name, path, password string) error {
+	return p.LoadKey(name, &PFXKeySource{Path: path, Password: password})
+}
+
+// LoadKey loads a signing certificate and its crypto.Signer from ks and
+// registers it under name.
+func (p *Processor) LoadKey(name string, ks KeySource) error {
 	if _, ok := p.certs[name]; ok {
 		return fmt.Errorf("the name '%s' is already loaded", name)
 	}
 
-	// Get private key and X509 certificate from the P12 file.
-	pfxData, err := ioutil.ReadFile(path)
+	cert, err := ks.Load()
 	if err != nil {
 		return err
 	}
+	p.certs[name] = cert
+	return nil
+}
 
-	priv, c, _, err := pkcs12.DecodeChain(pfxData, password)
-	if err != nil {
-		log.Fatalf("decode failed: %v", err)
-	}
-	p.certs[name] = &Certificate{
-		Cert:    c,
-		PrivKey: priv.(*rsa.PrivateKey),
+// LoadKeys loads and registers every key described in keys, as configured in
+// the `keys` section of props.json.
+func (p *Processor) LoadKeys(keys []KeyConfig) error {
+	for _, k := range keys {
+		if k.Name == "" {
+			return errors.New("key in 'keys' config is missing a 'name'")
+		}
+		ks, err := k.keySource()
+		if err != nil {
+			return err
+		}
+		if err := p.LoadKey(k.Name, ks); err != nil {
+			return fmt.Errorf("error loading key '%s': %v", k.Name, err)
+		}
 	}
 	return nil
 }
@@ -290,7 +451,7 @@ func (p *Processor) signPDF(cert *Certificate, pr SignProps, rd *model.PdfReader
 	}
 
 	// Create signature handler.
-	h, err := sighandler.NewAdobePKCS7Detached(cert.PrivKey, cert.Cert)
+	h, err := newPKCS7DetachedHandler(cert.Signer, cert.Cert, cert.Chain, pr.Timestamp, p.logger, p.metrics)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,177 @@
+package processor
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gunnsth/pkcs7"
+	"github.com/unidoc/unipdf/v3/core"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// pkcs7DetachedHandler is an Adobe.PPKMS/Adobe.PPKLite adbe.pkcs7.detached
+// signature handler, equivalent to sighandler.NewAdobePKCS7Detached, except
+// that it signs with any crypto.Signer (not just an in-memory *rsa.PrivateKey,
+// so PKCS#11-backed keys work too) and optionally embeds an RFC 3161
+// timestamp token (PAdES-B-T) on the CMS SignerInfo as an unsigned attribute.
+type pkcs7DetachedHandler struct {
+	signer      crypto.Signer
+	certificate *x509.Certificate
+	chain       []*x509.Certificate
+	timestamp   TimestampProps
+	logger      *log.Logger
+	metrics     Metrics
+
+	// sizing is set only for the throwaway placeholder Sign call
+	// InitSignature makes to size the /Contents reservation. It skips the
+	// TSA round trip: Contents is always zero-padded out to
+	// signatureContentsSize regardless of the token's actual length, so the
+	// placeholder pass gains nothing from a real timestamp and would
+	// otherwise double the TSA requests (and retry budget) per document.
+	sizing bool
+}
+
+// newPKCS7DetachedHandler creates a signature handler for the given signer
+// and certificate. chain, if any, is embedded alongside cert in the CMS
+// SignedData's certificate set (PAdES-B-LT requires the full chain to be
+// present for validation). If ts.Enabled, the signature's CMS SignerInfo is
+// timestamped by the configured TSA before being embedded in the PDF.
+func newPKCS7DetachedHandler(signer crypto.Signer, cert *x509.Certificate, chain []*x509.Certificate, ts TimestampProps, l *log.Logger, m Metrics) (model.SignatureHandler, error) {
+	return &pkcs7DetachedHandler{
+		signer:      signer,
+		certificate: cert,
+		chain:       chain,
+		timestamp:   ts,
+		logger:      l,
+		metrics:     m,
+	}, nil
+}
+
+// InitSignature initialises the PdfSignature.
+func (h *pkcs7DetachedHandler) InitSignature(sig *model.PdfSignature) error {
+	if h.certificate == nil {
+		return errors.New("certificate must not be nil")
+	}
+	if h.signer == nil {
+		return errors.New("signer must not be nil")
+	}
+
+	handler := *h
+	sig.Handler = &handler
+	sig.Filter = core.MakeName("Adobe.PPKLite")
+	sig.SubFilter = core.MakeName("adbe.pkcs7.detached")
+	sig.Reference = nil
+
+	digest, err := handler.NewDigest(sig)
+	if err != nil {
+		return err
+	}
+	digest.Write([]byte("calculate the Contents field size"))
+
+	handler.sizing = true
+	err = handler.Sign(sig, digest)
+	handler.sizing = false
+	return err
+}
+
+// NewDigest creates a new digest.
+func (h *pkcs7DetachedHandler) NewDigest(sig *model.PdfSignature) (model.Hasher, error) {
+	return bytes.NewBuffer(nil), nil
+}
+
+// Validate validates PdfSignature.
+func (h *pkcs7DetachedHandler) Validate(sig *model.PdfSignature, digest model.Hasher) (model.SignatureValidationResult, error) {
+	signed := sig.Contents.Bytes()
+	p7, err := pkcs7.Parse(signed)
+	if err != nil {
+		return model.SignatureValidationResult{}, err
+	}
+
+	buffer := digest.(*bytes.Buffer)
+	p7.Content = buffer.Bytes()
+	if err = p7.Verify(); err != nil {
+		return model.SignatureValidationResult{}, err
+	}
+
+	return model.SignatureValidationResult{
+		IsSigned:   true,
+		IsVerified: true,
+	}, nil
+}
+
+// signatureContentsSize is the fixed size (in bytes, before hex encoding)
+// reserved for the /Contents field. It must stay constant between the
+// placeholder Sign call InitSignature makes (to size the PDF's byte range)
+// and the real one that follows, so it's sized generously above an ordinary
+// signature: an RSA-4096 signature, the full signer chain embedded in the
+// CMS certificate set (chunk0-3), and, when enabled, an RFC 3161
+// TimeStampToken carrying the TSA's own chain (chunk0-1) can together run to
+// several kilobytes. It's a var, not a const, so tests can shrink it to
+// exercise the overflow error path without building an implausibly large
+// chain.
+var signatureContentsSize = 32 * 1024
+
+// Sign sets the Contents field, optionally embedding a TSA timestamp token.
+func (h *pkcs7DetachedHandler) Sign(sig *model.PdfSignature, digest model.Hasher) error {
+	buffer := digest.(*bytes.Buffer)
+
+	cms, err := newCMSSigner(buffer.Bytes(), h.signer, h.certificate, h.chain, h.timestamp.HashAlgo)
+	if err != nil {
+		return err
+	}
+
+	if h.timestamp.Enabled && !h.sizing {
+		if err := h.timestampSignerInfo(cms); err != nil {
+			return fmt.Errorf("error timestamping signature: %v", err)
+		}
+	}
+
+	detachedSignature, err := cms.Finish()
+	if err != nil {
+		return err
+	}
+	if len(detachedSignature) > signatureContentsSize {
+		return fmt.Errorf("signature is %d bytes, which exceeds the %d byte /Contents reservation (chain too large or TSA token too large)",
+			len(detachedSignature), signatureContentsSize)
+	}
+
+	data := make([]byte, signatureContentsSize)
+	copy(data, detachedSignature)
+
+	sig.Contents = core.MakeHexString(string(data))
+	return nil
+}
+
+// timestampSignerInfo requests an RFC 3161 timestamp token over the
+// SignerInfo's signature value from the configured TSA and attaches it as an
+// unsigned attribute (id-aa-timeStampToken).
+func (h *pkcs7DetachedHandler) timestampSignerInfo(cms *cmsSigner) error {
+	start := time.Now()
+	token, err := requestTimestamp(h.timestamp, cms.EncryptedDigest())
+	if err != nil {
+		h.metrics.ObserveTSARequest("error", time.Since(start))
+		return err
+	}
+	h.metrics.ObserveTSARequest("ok", time.Since(start))
+
+	if h.logger != nil {
+		h.logger.Printf("embedded TSA timestamp token from %s", h.timestamp.URL)
+	}
+
+	cms.SetUnauthenticatedAttribute(oidTimestampToken, asn1.RawValue{Class: 0, Tag: 17, IsCompound: true, Bytes: token}) // 17 == SET
+	return nil
+}
+
+// IsApplicable returns true if the signature handler is applicable for the PdfSignature.
+func (h *pkcs7DetachedHandler) IsApplicable(sig *model.PdfSignature) bool {
+	if sig == nil || sig.Filter == nil || sig.SubFilter == nil {
+		return false
+	}
+	return (*sig.Filter == "Adobe.PPKMS" || *sig.Filter == "Adobe.PPKLite") && *sig.SubFilter == "adbe.pkcs7.detached"
+}
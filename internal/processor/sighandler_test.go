@@ -0,0 +1,281 @@
+package processor
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gunnsth/pkcs7"
+	"github.com/unidoc/unipdf/v3/model"
+)
+
+// fakeTSA is a minimal RFC 3161 TSA: it parses the incoming TimeStampReq,
+// builds a TSTInfo echoing the request's MessageImprint, and signs it with
+// its own self-signed certificate, so requestTimestamp/Sign can be exercised
+// without a real network TSA.
+type fakeTSA struct {
+	cert   *x509.Certificate
+	key    *rsa.PrivateKey
+	reject bool
+}
+
+func newFakeTSA(t *testing.T) *fakeTSA {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating TSA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake TSA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating TSA cert: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error parsing TSA cert: %v", err)
+	}
+	return &fakeTSA{cert: cert, key: key}
+}
+
+func (f *fakeTSA) handler(t *testing.T) http.HandlerFunc {
+	t.Helper()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var req timeStampReq
+		if _, err := asn1.Unmarshal(body, &req); err != nil {
+			http.Error(w, fmt.Sprintf("bad TimeStampReq: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		var resp timeStampResp
+		if f.reject {
+			resp = timeStampResp{Status: pkiStatusInfo{Status: 2, StatusString: []string{"rejected by fake TSA"}}}
+		} else {
+			token, err := f.issueToken(req.MessageImprint)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp = timeStampResp{
+				Status:         pkiStatusInfo{Status: 0},
+				TimeStampToken: asn1.RawValue{FullBytes: token},
+			}
+		}
+
+		respDER, err := asn1.Marshal(resp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/timestamp-reply")
+		w.Write(respDER)
+	}
+}
+
+// issueToken builds and signs a TSTInfo (the content of the TimeStampToken
+// CMS SignedData) whose MessageImprint is imprint.
+func (f *fakeTSA) issueToken(imprint messageImprint) ([]byte, error) {
+	info := tstInfo{
+		Version:        1,
+		Policy:         asn1.ObjectIdentifier{1, 2, 3},
+		MessageImprint: imprint,
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		GenTime:        time.Now().UTC(),
+	}
+	infoDER, err := asn1.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding TSTInfo: %v", err)
+	}
+
+	sd, err := pkcs7.NewSignedData(infoDER)
+	if err != nil {
+		return nil, fmt.Errorf("error creating TimeStampToken SignedData: %v", err)
+	}
+	if err := sd.AddSigner(f.cert, f.key, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, fmt.Errorf("error signing TimeStampToken: %v", err)
+	}
+	return sd.Finish()
+}
+
+func TestRequestTimestamp(t *testing.T) {
+	tsa := newFakeTSA(t)
+	srv := httptest.NewServer(tsa.handler(t))
+	defer srv.Close()
+
+	sigValue := []byte("a fake SignerInfo signature value")
+	token, err := requestTimestamp(TimestampProps{URL: srv.URL, HashAlgo: "sha256"}, sigValue)
+	if err != nil {
+		t.Fatalf("requestTimestamp: %v", err)
+	}
+	if len(token) == 0 {
+		t.Fatal("requestTimestamp returned an empty token")
+	}
+
+	h := crypto.SHA256.New()
+	h.Write(sigValue)
+	if err := verifyTimestampToken(token, h.Sum(nil)); err != nil {
+		t.Fatalf("verifyTimestampToken: %v", err)
+	}
+}
+
+func TestRequestTimestampRejected(t *testing.T) {
+	tsa := newFakeTSA(t)
+	tsa.reject = true
+	srv := httptest.NewServer(tsa.handler(t))
+	defer srv.Close()
+
+	if _, err := requestTimestamp(TimestampProps{URL: srv.URL, HashAlgo: "sha256", Retries: 0}, []byte("x")); err == nil {
+		t.Fatal("expected an error from a rejecting TSA, got nil")
+	}
+}
+
+// TestSignEmbedsTimestampToken exercises pkcs7DetachedHandler.Sign end to
+// end with timestamping enabled against a fake TSA, confirming the CMS
+// SignerInfo carries an unauthenticated id-aa-timeStampToken attribute and
+// /Contents isn't truncated. InitSignature's placeholder pass skips the TSA
+// (see TestInitSignatureSkipsTSA), so the real digest is signed explicitly
+// here, the way the appender's Write does.
+func TestSignEmbedsTimestampToken(t *testing.T) {
+	tsa := newFakeTSA(t)
+	srv := httptest.NewServer(tsa.handler(t))
+	defer srv.Close()
+
+	cert, key := newTestSigningCert(t)
+	h, err := newPKCS7DetachedHandler(key, cert, nil, TimestampProps{
+		Enabled:  true,
+		URL:      srv.URL,
+		HashAlgo: "sha256",
+	}, nil, NopMetrics{})
+	if err != nil {
+		t.Fatalf("newPKCS7DetachedHandler: %v", err)
+	}
+
+	sig := &model.PdfSignature{}
+	if err := h.InitSignature(sig); err != nil {
+		t.Fatalf("InitSignature: %v", err)
+	}
+
+	digest, err := sig.Handler.NewDigest(sig)
+	if err != nil {
+		t.Fatalf("NewDigest: %v", err)
+	}
+	digest.Write([]byte("the actual PDF byte range"))
+	if err := sig.Handler.Sign(sig, digest); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	p7, err := pkcs7.Parse(sig.Contents.Bytes())
+	if err != nil {
+		t.Fatalf("error parsing embedded CMS: %v", err)
+	}
+	if len(p7.Signers) != 1 {
+		t.Fatalf("expected 1 SignerInfo, got %d", len(p7.Signers))
+	}
+	attrs := p7.Signers[0].UnauthenticatedAttributes
+	if len(attrs) != 1 || !attrs[0].Type.Equal(oidTimestampToken) {
+		t.Fatalf("expected a single id-aa-timeStampToken unauthenticated attribute, got %v", attrs)
+	}
+}
+
+// TestInitSignatureSkipsTSA confirms the placeholder Sign call InitSignature
+// makes to size /Contents doesn't also hit the TSA: Contents is zero-padded
+// to a fixed reservation regardless of the token's real length, so a second
+// live timestamp request there would only cost latency and retry budget for
+// no benefit.
+func TestInitSignatureSkipsTSA(t *testing.T) {
+	tsa := newFakeTSA(t)
+	base := tsa.handler(t)
+
+	var hits int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		base(w, r)
+	}))
+	defer srv.Close()
+
+	cert, key := newTestSigningCert(t)
+	h, err := newPKCS7DetachedHandler(key, cert, nil, TimestampProps{
+		Enabled:  true,
+		URL:      srv.URL,
+		HashAlgo: "sha256",
+	}, nil, NopMetrics{})
+	if err != nil {
+		t.Fatalf("newPKCS7DetachedHandler: %v", err)
+	}
+
+	sig := &model.PdfSignature{}
+	if err := h.InitSignature(sig); err != nil {
+		t.Fatalf("InitSignature: %v", err)
+	}
+	if hits != 0 {
+		t.Fatalf("InitSignature hit the TSA %d time(s), want 0", hits)
+	}
+}
+
+// TestSignErrorsOnOverflow confirms Sign fails loudly instead of silently
+// truncating when the CMS signature doesn't fit in the reserved /Contents
+// buffer.
+func TestSignErrorsOnOverflow(t *testing.T) {
+	old := signatureContentsSize
+	signatureContentsSize = 16
+	defer func() { signatureContentsSize = old }()
+
+	cert, key := newTestSigningCert(t)
+	h, err := newPKCS7DetachedHandler(key, cert, nil, TimestampProps{}, nil, NopMetrics{})
+	if err != nil {
+		t.Fatalf("newPKCS7DetachedHandler: %v", err)
+	}
+
+	sig := &model.PdfSignature{}
+	if err := h.InitSignature(sig); err == nil {
+		t.Fatal("expected InitSignature to fail when the signature overflows the reserved buffer, got nil")
+	}
+}
+
+// newTestSigningCert returns a self-signed RSA certificate/key pair suitable
+// for exercising the signature handler in tests.
+func newTestSigningCert(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating signing key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating signing cert: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error parsing signing cert: %v", err)
+	}
+	return cert, key
+}
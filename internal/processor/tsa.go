@@ -0,0 +1,249 @@
+package processor
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gunnsth/pkcs7"
+)
+
+// oidTimestampToken is the CMS unsigned attribute OID (id-aa-timeStampToken)
+// under which an RFC 3161 TimeStampToken is embedded in a SignerInfo.
+var oidTimestampToken = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 14}
+
+// defaultTSATimeout and defaultTSARetries are used when SignProps.Timestamp
+// does not specify them.
+const (
+	defaultTSATimeout = 30 * time.Second
+	defaultTSARetries = 2
+)
+
+// algorithmIdentifier mirrors the ASN.1 AlgorithmIdentifier used in
+// RFC 3161 MessageImprint.
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+// messageImprint is the RFC 3161 MessageImprint structure.
+type messageImprint struct {
+	HashAlgorithm algorithmIdentifier
+	HashedMessage []byte
+}
+
+// timeStampReq is the RFC 3161 TimeStampReq structure.
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional,default:false"`
+}
+
+// pkiStatusInfo is the RFC 3161 PKIStatusInfo structure.
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional,utf8"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+// timeStampResp is the RFC 3161 TimeStampResp structure.
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// tstInfo is the RFC 3161 TSTInfo structure embedded as the content of the
+// TimeStampToken's CMS SignedData.
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time     `asn1:"generalized"`
+	Accuracy       asn1.RawValue `asn1:"optional"`
+	Ordering       bool          `asn1:"optional,default:false"`
+	Nonce          *big.Int      `asn1:"optional"`
+	TSA            asn1.RawValue `asn1:"optional,tag:0"`
+	Extensions     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// tsaHashOID resolves a SignProps.Timestamp.HashAlgo name to its crypto.Hash
+// and ASN.1 digest algorithm OID. It defaults to SHA-256.
+func tsaHashOID(name string) (crypto.Hash, asn1.ObjectIdentifier, error) {
+	switch strings.ToLower(name) {
+	case "", "sha256":
+		return crypto.SHA256, pkcs7.OIDDigestAlgorithmSHA256, nil
+	case "sha1":
+		return crypto.SHA1, pkcs7.OIDDigestAlgorithmSHA1, nil
+	case "sha384":
+		return crypto.SHA384, pkcs7.OIDDigestAlgorithmSHA384, nil
+	case "sha512":
+		return crypto.SHA512, pkcs7.OIDDigestAlgorithmSHA512, nil
+	default:
+		return 0, nil, fmt.Errorf("unsupported timestamp hashAlgo '%s'", name)
+	}
+}
+
+// requestTimestamp asks the TSA configured in ts for an RFC 3161 timestamp
+// token over sigValue (the CMS SignerInfo's signature value) and returns the
+// DER encoded TimeStampToken (a CMS ContentInfo) ready to be attached as an
+// unsigned attribute.
+func requestTimestamp(ts TimestampProps, sigValue []byte) ([]byte, error) {
+	hash, hashOID, err := tsaHashOID(ts.HashAlgo)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write(sigValue)
+	imprint := h.Sum(nil)
+
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, fmt.Errorf("error generating TSA nonce: %v", err)
+	}
+
+	req := timeStampReq{
+		Version: 1,
+		MessageImprint: messageImprint{
+			HashAlgorithm: algorithmIdentifier{Algorithm: hashOID},
+			HashedMessage: imprint,
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	}
+	if ts.PolicyOID != "" {
+		oid, err := parseOID(ts.PolicyOID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp policyOID: %v", err)
+		}
+		req.ReqPolicy = oid
+	}
+
+	reqDER, err := asn1.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding TimeStampReq: %v", err)
+	}
+
+	timeout := time.Duration(ts.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTSATimeout
+	}
+	retries := ts.Retries
+	if retries <= 0 {
+		retries = defaultTSARetries
+	}
+
+	client := &http.Client{Timeout: timeout}
+
+	var (
+		respDER []byte
+		lastErr error
+	)
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 250 * time.Millisecond)
+		}
+
+		respDER, lastErr = postTimestampReq(client, ts, reqDER)
+		if lastErr == nil {
+			break
+		}
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("error requesting timestamp from TSA '%s': %v", ts.URL, lastErr)
+	}
+
+	var resp timeStampResp
+	if _, err := asn1.Unmarshal(respDER, &resp); err != nil {
+		return nil, fmt.Errorf("error parsing TimeStampResp: %v", err)
+	}
+
+	// PKIStatus: granted(0) and grantedWithMods(1) are the only successful
+	// outcomes.
+	if resp.Status.Status != 0 && resp.Status.Status != 1 {
+		return nil, fmt.Errorf("TSA rejected timestamp request (status=%d): %s",
+			resp.Status.Status, strings.Join(resp.Status.StatusString, "; "))
+	}
+	if len(resp.TimeStampToken.FullBytes) == 0 {
+		return nil, errors.New("TSA response did not include a TimeStampToken")
+	}
+
+	token := resp.TimeStampToken.FullBytes
+	if err := verifyTimestampToken(token, imprint); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// postTimestampReq sends a single RFC 3161 TimeStampReq to the TSA and
+// returns the raw TimeStampResp body.
+func postTimestampReq(client *http.Client, ts TimestampProps, reqDER []byte) ([]byte, error) {
+	httpReq, err := http.NewRequest(http.MethodPost, ts.URL, bytes.NewReader(reqDER))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/timestamp-query")
+	if ts.Username != "" {
+		httpReq.SetBasicAuth(ts.Username, ts.Password)
+	}
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s: %s", resp.Status, strconv.Quote(string(body)))
+	}
+	return body, nil
+}
+
+// verifyTimestampToken parses the CMS SignedData wrapping token and checks
+// that its TSTInfo's MessageImprint matches the digest that was requested.
+func verifyTimestampToken(token, wantImprint []byte) error {
+	p7, err := pkcs7.Parse(token)
+	if err != nil {
+		return fmt.Errorf("error parsing TimeStampToken: %v", err)
+	}
+
+	var info tstInfo
+	if _, err := asn1.Unmarshal(p7.Content, &info); err != nil {
+		return fmt.Errorf("error parsing TSTInfo: %v", err)
+	}
+	if !bytes.Equal(info.MessageImprint.HashedMessage, wantImprint) {
+		return errors.New("TSA TimeStampToken's message imprint does not match the signature digest")
+	}
+	return nil
+}
+
+// parseOID parses a dotted-decimal OID string, eg: "1.2.3.4".
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID component '%s'", p)
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knadh/pfxsigner/internal/processor"
+)
+
+// jobStatus is the lifecycle state of an async signing job.
+type jobStatus string
+
+const (
+	jobQueued  jobStatus = "queued"
+	jobRunning jobStatus = "running"
+	jobDone    jobStatus = "done"
+	jobFailed  jobStatus = "failed"
+)
+
+// jobRecord tracks the lifecycle of a single async signing job submitted to
+// POST /jobs.
+type jobRecord struct {
+	ID         string    `json:"id"`
+	Status     jobStatus `json:"status"`
+	CertName   string    `json:"certName"`
+	CreatedAt  time.Time `json:"createdAt"`
+	StartedAt  time.Time `json:"startedAt,omitempty"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ResultSize int64     `json:"resultSize,omitempty"`
+
+	// Subject is the authenticated OIDC subject that submitted the job, if
+	// OIDC auth is enabled (empty otherwise), for audit logging.
+	Subject string `json:"subject,omitempty"`
+
+	// inputPath is where the job's input PDF was written, not serialized
+	// to API responses. Purge removes it alongside resultPath so inputs
+	// don't accumulate in the work dir forever.
+	inputPath string
+
+	// resultPath is where the signed PDF was written, not serialized to
+	// API responses.
+	resultPath string
+}
+
+// JobStore persists jobRecords across the async job API's lifecycle. A
+// restart shouldn't lose in-flight or completed job state, hence the
+// interface instead of keeping records solely in process memory.
+type JobStore interface {
+	// Put stores a copy of j, so later mutations the caller makes to j
+	// aren't visible until it calls Put again.
+	Put(j *jobRecord) error
+
+	// Get returns a copy of the stored record, safe for the caller to read
+	// or mutate (and write back via Put) without racing concurrent
+	// Put/Get calls from other goroutines (markRunning/finish run from
+	// Processor.Listen's worker goroutines, concurrently with HTTP
+	// handlers reading the same job's status/result).
+	Get(id string) (*jobRecord, bool)
+
+	// Purge deletes every finished job older than before, along with its
+	// input and result files.
+	Purge(before time.Time) error
+}
+
+// memJobStore is the default in-memory JobStore. Job state doesn't survive a
+// process restart.
+type memJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*jobRecord
+}
+
+func newMemJobStore() *memJobStore {
+	return &memJobStore{jobs: make(map[string]*jobRecord)}
+}
+
+// Put implements JobStore. It stores a copy of j, so the map never shares a
+// *jobRecord with a caller that might go on to mutate it outside the lock.
+func (s *memJobStore) Put(j *jobRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := *j
+	s.jobs[j.ID] = &cp
+	return nil
+}
+
+// Get implements JobStore. It returns a copy of the stored record, so the
+// caller can read or mutate it freely without racing a concurrent
+// Put/Get/Purge.
+func (s *memJobStore) Get(id string) (*jobRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	cp := *j
+	return &cp, true
+}
+
+// Purge implements JobStore.
+func (s *memJobStore) Purge(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, j := range s.jobs {
+		if j.FinishedAt.IsZero() || j.FinishedAt.After(before) {
+			continue
+		}
+		if j.inputPath != "" {
+			os.Remove(j.inputPath)
+		}
+		if j.resultPath != "" {
+			os.Remove(j.resultPath)
+		}
+		delete(s.jobs, id)
+	}
+	return nil
+}
+
+// boltJobStore is a stub for a durable BoltDB-backed JobStore, so a restart
+// doesn't lose job state the way memJobStore does. Wiring it up needs a
+// boltdb/bbolt dependency and a bucket/encoding scheme, tracked separately;
+// callers that need durability today should front pfxsigner with their own
+// job-state mirror instead.
+type boltJobStore struct{}
+
+func newBoltJobStore(path string) (*boltJobStore, error) {
+	return nil, fmt.Errorf("bolt job store is not implemented yet; use the in-memory default")
+}
+
+// Put implements JobStore.
+func (s *boltJobStore) Put(j *jobRecord) error { return fmt.Errorf("bolt job store not implemented") }
+
+// Get implements JobStore.
+func (s *boltJobStore) Get(id string) (*jobRecord, bool) { return nil, false }
+
+// Purge implements JobStore.
+func (s *boltJobStore) Purge(before time.Time) error {
+	return fmt.Errorf("bolt job store not implemented")
+}
+
+// jobManager runs the async job API's worker pool on top of the same
+// processor.Job/Processor.Listen mechanism CLI mode uses, and records each
+// job's lifecycle in a JobStore.
+type jobManager struct {
+	store     JobStore
+	workDir   string
+	queue     chan processor.Job
+	retention time.Duration
+}
+
+// newJobManager creates workDir if needed, starts workers workers consuming
+// the async job queue via proc.Listen, and, if retention is positive, a
+// background sweep that purges finished jobs older than it.
+func newJobManager(proc *processor.Processor, store JobStore, workDir string, queueSize, workers int, retention time.Duration) (*jobManager, error) {
+	if err := os.MkdirAll(workDir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating job work dir '%s': %v", workDir, err)
+	}
+
+	m := &jobManager{
+		store:     store,
+		workDir:   workDir,
+		queue:     make(chan processor.Job, queueSize),
+		retention: retention,
+	}
+
+	proc.Wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go proc.Listen(m.queue)
+	}
+
+	if retention > 0 {
+		go m.gcLoop()
+	}
+
+	return m, nil
+}
+
+// gcLoop periodically purges jobs finished more than m.retention ago.
+func (m *jobManager) gcLoop() {
+	interval := m.retention / 2
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	for range time.Tick(interval) {
+		if err := m.store.Purge(time.Now().Add(-m.retention)); err != nil {
+			logger.Printf("error purging job store: %v", err)
+		}
+	}
+}
+
+// resolveInFile validates that name refers to a file inside m.workDir and
+// returns its full path. It rejects absolute paths and "../" escapes, so a
+// caller entitled to use at least one certName can't use POST /jobs's JSON
+// "inFile" field to read an arbitrary file the server process can access,
+// such as another tenant's "<id>-in.pdf" sitting in the same work dir.
+func (m *jobManager) resolveInFile(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("`inFile` is required")
+	}
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("inFile '%s' must be a path relative to the job work dir", name)
+	}
+
+	full := filepath.Join(m.workDir, name)
+	rel, err := filepath.Rel(m.workDir, full)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("inFile '%s' escapes the job work dir", name)
+	}
+
+	// enqueue writes every job's own input and output as "<id>-in.pdf" and
+	// "<id>-out.pdf" in the work dir; those belong to other jobs.
+	if ok, _ := regexp.MatchString(`^[0-9a-f]{32}-(in|out)\.pdf$`, rel); ok {
+		return "", fmt.Errorf("inFile '%s' refers to another job's file", name)
+	}
+	return full, nil
+}
+
+// enqueue copies r to a job input file, registers a queued jobRecord, and
+// pushes a processor.Job referencing it onto the shared queue. subject is
+// the authenticated OIDC subject that submitted the job, or "" if OIDC auth
+// is disabled; it's recorded on the jobRecord for audit logging. It returns
+// the new job's ID.
+func (m *jobManager) enqueue(certName, subject string, props *processor.SignProps, r io.Reader) (string, error) {
+	id, err := newJobID()
+	if err != nil {
+		return "", err
+	}
+
+	inFile := filepath.Join(m.workDir, id+"-in.pdf")
+	f, err := os.Create(inFile)
+	if err != nil {
+		return "", fmt.Errorf("error creating job input file: %v", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(inFile)
+		return "", fmt.Errorf("error writing job input file: %v", err)
+	}
+	f.Close()
+
+	outFile := filepath.Join(m.workDir, id+"-out.pdf")
+	rec := &jobRecord{ID: id, Status: jobQueued, CertName: certName, Subject: subject, CreatedAt: time.Now(), inputPath: inFile}
+	if err := m.store.Put(rec); err != nil {
+		return "", err
+	}
+
+	m.queue <- processor.Job{
+		CertName: certName,
+		InFile:   inFile,
+		OutFile:  outFile,
+		Props:    props,
+		Started:  func() { m.markRunning(id) },
+		Done:     func(jobErr error) { m.finish(id, outFile, jobErr) },
+	}
+
+	return id, nil
+}
+
+// markRunning transitions a job from queued to running.
+func (m *jobManager) markRunning(id string) {
+	rec, ok := m.store.Get(id)
+	if !ok {
+		return
+	}
+	rec.Status = jobRunning
+	rec.StartedAt = time.Now()
+	m.store.Put(rec)
+}
+
+// finish records a job's terminal state: done with its result file, or
+// failed with jobErr's message. It also writes the audit log line for the
+// job, same as handleSignDocument does for synchronous /sign requests,
+// so documents signed through the async job API aren't left unaudited.
+func (m *jobManager) finish(id, outFile string, jobErr error) {
+	rec, ok := m.store.Get(id)
+	if !ok {
+		return
+	}
+
+	rec.FinishedAt = time.Now()
+	outcome := "signed"
+	if jobErr != nil {
+		rec.Status = jobFailed
+		rec.Error = jobErr.Error()
+		outcome = "error"
+	} else {
+		rec.Status = jobDone
+		rec.resultPath = outFile
+		if fi, err := os.Stat(outFile); err == nil {
+			rec.ResultSize = fi.Size()
+		}
+	}
+	m.store.Put(rec)
+
+	var inSize int64
+	if fi, err := os.Stat(rec.inputPath); err == nil {
+		inSize = fi.Size()
+	}
+	auditLog(rec.Subject, rec.CertName, inSize, rec.FinishedAt.Sub(rec.CreatedAt), outcome)
+}
+
+// newJobID returns a random hex job ID.
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating job ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -10,9 +10,11 @@ import (
 )
 
 var (
-	buildString = ""
-	proc        *processor.Processor
-	logger      *log.Logger
+	buildString  = ""
+	proc         *processor.Processor
+	logger       *log.Logger
+	jobs         *jobManager
+	oidcAuthInst *oidcAuth
 )
 
 func init() {
@@ -33,6 +35,14 @@ func main() {
 		cli.StringFlag{Name: "pfx-password", Value: "", Usage: "PFX password"},
 		cli.StringFlag{Name: "password", Value: "", Usage: "nest password"},
 		cli.StringFlag{Name: "props-file", Value: "props.json", Usage: "path to the JSON file with default signature properties", TakesFile: true},
+
+		// PKCS#11 flags for the "default" key. When --pkcs11-module is set,
+		// it takes precedence over --pfx-file/--pfx-password.
+		cli.StringFlag{Name: "pkcs11-module", Value: "", Usage: "path to the PKCS#11 module (enables the HSM backed 'default' key)", EnvVar: "PKCS11_MODULE"},
+		cli.UintFlag{Name: "pkcs11-slot", Value: 0, Usage: "PKCS#11 slot to open", EnvVar: "PKCS11_SLOT"},
+		cli.StringFlag{Name: "pkcs11-label", Value: "", Usage: "CKA_LABEL of the signing key and certificate", EnvVar: "PKCS11_LABEL"},
+		cli.StringFlag{Name: "pkcs11-id", Value: "", Usage: "CKA_ID of the signing key and certificate", EnvVar: "PKCS11_ID"},
+		cli.StringFlag{Name: "pkcs11-pin", Value: "", Usage: "PKCS#11 token PIN", EnvVar: "PKCS11_PIN"},
 	}
 	app.Commands = []cli.Command{
 		// Request-response mode.
@@ -42,6 +52,7 @@ func main() {
 			Flags: []cli.Flag{
 				cli.IntFlag{Name: "workers", Value: 2,
 					Usage: "number of workers to run for signing"},
+				cli.StringFlag{Name: "metrics-address", Value: "", Usage: "address to serve a Prometheus /metrics sidecar on (disabled if unset)", EnvVar: "METRICS_ADDRESS"},
 			},
 			Action: initApp(initCLI),
 		},
@@ -55,6 +66,19 @@ func main() {
 					Usage: "address to listen on"},
 				cli.DurationFlag{Name: "timeout", Value: time.Second * 30,
 					Usage: "request timeout (eg: 10s)"},
+
+				// OIDC auth. If --oidc-issuer is unset, /sign stays
+				// unauthenticated as before.
+				cli.StringFlag{Name: "oidc-issuer", Value: "", Usage: "OIDC issuer URL (enables bearer token auth on /sign)", EnvVar: "OIDC_ISSUER"},
+				cli.StringFlag{Name: "oidc-client-id", Value: "", Usage: "OIDC client ID to verify the token's audience against", EnvVar: "OIDC_CLIENT_ID"},
+				cli.StringFlag{Name: "oidc-audience", Value: "", Usage: "additional required audience value, if different from oidc-client-id", EnvVar: "OIDC_AUDIENCE"},
+				cli.StringFlag{Name: "oidc-claims-map", Value: "", Usage: "path to a JSON file mapping subject/group claims to allowed certNames", TakesFile: true, EnvVar: "OIDC_CLAIMS_MAP"},
+
+				// Async job API (POST /jobs, GET /jobs/{id}, GET /jobs/{id}/result).
+				cli.StringFlag{Name: "job-work-dir", Value: "/tmp/pfxsigner-jobs", Usage: "directory to store async job input/output PDFs in"},
+				cli.IntFlag{Name: "job-queue-size", Value: 100, Usage: "max number of async jobs that may be queued at once"},
+				cli.IntFlag{Name: "job-workers", Value: 2, Usage: "number of workers processing async jobs"},
+				cli.DurationFlag{Name: "job-retention", Value: time.Hour * 24, Usage: "how long to keep finished async jobs and their result files before GC (0 disables GC)"},
 			},
 			Action: initApp(initServer),
 		},
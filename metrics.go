@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// promMetrics implements processor.Metrics on top of the Prometheus client,
+// giving operators the same kind of runtime visibility into sign throughput,
+// latency and dependency (TSA) health that comparable long-running
+// signing services expose.
+type promMetrics struct {
+	signTotal    *prometheus.CounterVec
+	signDuration *prometheus.HistogramVec
+	pdfBytesIn   *prometheus.HistogramVec
+	pdfBytesOut  *prometheus.HistogramVec
+	queueDepth   prometheus.Gauge
+	tsaDuration  *prometheus.HistogramVec
+}
+
+// newPromMetrics creates and registers the pfxsigner_* Prometheus
+// collectors against reg.
+func newPromMetrics(reg prometheus.Registerer) *promMetrics {
+	m := &promMetrics{
+		signTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pfxsigner_sign_total",
+			Help: "Total number of PDF signing requests, by certificate and outcome.",
+		}, []string{"cert", "outcome"}),
+
+		signDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pfxsigner_sign_duration_seconds",
+			Help:    "Time taken to sign a PDF, by certificate.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"cert"}),
+
+		pdfBytesIn: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pfxsigner_pdf_bytes_in",
+			Help:    "Size of input PDFs, by certificate.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+		}, []string{"cert"}),
+
+		pdfBytesOut: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pfxsigner_pdf_bytes_out",
+			Help:    "Size of signed output PDFs, by certificate.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+		}, []string{"cert"}),
+
+		queueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "pfxsigner_queue_depth",
+			Help: "Number of jobs currently queued for workers (CLI mode, or the server's async job API).",
+		}),
+
+		tsaDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pfxsigner_tsa_request_duration_seconds",
+			Help:    "Time taken for RFC 3161 timestamp requests, by outcome.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"outcome"}),
+	}
+
+	reg.MustRegister(m.signTotal, m.signDuration, m.pdfBytesIn, m.pdfBytesOut,
+		m.queueDepth, m.tsaDuration)
+	return m
+}
+
+// ObserveSign implements processor.Metrics.
+func (m *promMetrics) ObserveSign(cert, outcome string, dur time.Duration) {
+	m.signTotal.WithLabelValues(cert, outcome).Inc()
+	m.signDuration.WithLabelValues(cert).Observe(dur.Seconds())
+}
+
+// ObservePDFBytes implements processor.Metrics.
+func (m *promMetrics) ObservePDFBytes(cert string, in, out int) {
+	m.pdfBytesIn.WithLabelValues(cert).Observe(float64(in))
+	m.pdfBytesOut.WithLabelValues(cert).Observe(float64(out))
+}
+
+// ObserveTSARequest implements processor.Metrics.
+func (m *promMetrics) ObserveTSARequest(outcome string, dur time.Duration) {
+	m.tsaDuration.WithLabelValues(outcome).Observe(dur.Seconds())
+}
+
+// SetQueueDepth implements processor.Metrics.
+func (m *promMetrics) SetQueueDepth(n int) {
+	m.queueDepth.Set(float64(n))
+}
+
+// metricsHandler returns an http.Handler serving the registered metrics in
+// the Prometheus exposition format.
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// serveMetrics starts a dedicated HTTP listener exposing /metrics on addr.
+// It's used as a CLI-mode sidecar, since CLI mode otherwise runs no HTTP
+// server of its own.
+func serveMetrics(addr string) {
+	logger.Printf("starting metrics listener on %s", addr)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Printf("error starting metrics listener: %v", err)
+	}
+}
@@ -3,7 +3,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/knadh/pfxsigner/internal/processor"
@@ -21,7 +25,48 @@ func initServer(c *cli.Context) error {
 	r := chi.NewRouter()
 	r.Get("/", handleIndex)
 	r.Get("/health", handleHealthCheck)
-	r.Post("/sign/{certName}", handleSignDocument)
+	r.Handle("/metrics", metricsHandler())
+
+	// Only require OIDC auth when it's been configured, so existing
+	// deployments that don't pass the --oidc-* flags keep working exactly
+	// as before.
+	if issuer := c.String("oidc-issuer"); issuer != "" {
+		auth, err := newOIDCAuth(issuer, c.String("oidc-client-id"), c.String("oidc-audience"), c.String("oidc-claims-map"))
+		if err != nil {
+			return fmt.Errorf("error setting up OIDC auth: %v", err)
+		}
+		logger.Printf("OIDC auth enabled against issuer %s", issuer)
+		oidcAuthInst = auth
+
+		r.With(auth.middleware).Post("/sign/{certName}", handleSignDocument)
+	} else {
+		r.Post("/sign/{certName}", handleSignDocument)
+	}
+
+	// Async job API: queues signing work onto the same processor.Job /
+	// Processor.Listen mechanism CLI mode uses, so callers can poll
+	// instead of holding a connection open for the duration of a
+	// TSA-dependent sign. Scoped by the same per-client certName
+	// allow-list as /sign when OIDC auth is enabled: handleJobCreate checks
+	// the requested certName against the caller's claims at enqueue time,
+	// and handleJobStatus/handleJobResult re-check the job's stored
+	// certName at fetch time, so a caller who merely learns another
+	// client's job ID can't poll or download its result.
+	jm, err := newJobManager(proc, newMemJobStore(), c.String("job-work-dir"),
+		c.Int("job-queue-size"), c.Int("job-workers"), c.Duration("job-retention"))
+	if err != nil {
+		return fmt.Errorf("error starting job manager: %v", err)
+	}
+	jobs = jm
+	if oidcAuthInst != nil {
+		r.With(oidcAuthInst.jobsMiddleware).Post("/jobs", handleJobCreate)
+		r.With(oidcAuthInst.jobsMiddleware).Get("/jobs/{id}", handleJobStatus)
+		r.With(oidcAuthInst.jobsMiddleware).Get("/jobs/{id}/result", handleJobResult)
+	} else {
+		r.Post("/jobs", handleJobCreate)
+		r.Get("/jobs/{id}", handleJobStatus)
+		r.Get("/jobs/{id}/result", handleJobResult)
+	}
 
 	// HTTP Server.
 	srv := &http.Server{
@@ -73,7 +118,7 @@ func handleSignDocument(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get the file.
-	file, _, err := r.FormFile("file")
+	file, header, err := r.FormFile("file")
 	if err != nil {
 		logger.Printf("invalid file in the `file` field: %v", err)
 		sendErrorResponse(w, "Invalid file in the `file` field.",
@@ -81,19 +126,194 @@ func handleSignDocument(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var (
+		subject = subjectFromContext(r.Context())
+		start   = time.Now()
+	)
+
 	// Sign the document.
-	out, err := proc.ProcessDoc(certName, props, "", file)
+	out, err := proc.ProcessDoc(certName, props, nil, file)
 	if err != nil {
 		logger.Printf("error processing document: %v", err)
+		auditLog(subject, certName, header.Size, time.Since(start), "error")
 		sendErrorResponse(w, fmt.Sprintf("Error processing document: %v", err),
 			http.StatusInternalServerError, nil)
 		return
 	}
+	auditLog(subject, certName, header.Size, time.Since(start), "signed")
 
 	w.Header().Set("content-type", "application/pdf")
 	w.Write(out)
 }
 
+// jobCertAllowed checks certName against the request's authenticated claims
+// when OIDC auth is enabled (oidcAuthInst != nil), writing a 403 response
+// and returning false if the caller isn't allowed to use it, the same
+// allow-list /sign/{certName} enforces. With auth disabled it always
+// allows, matching /sign's behavior. Used both at job enqueue time (on the
+// requested certName) and at status/result-fetch time (on the job's stored
+// certName), so a caller who learns another client's job ID can't use it
+// to poll or download a cert it isn't allowed to sign with.
+func jobCertAllowed(w http.ResponseWriter, r *http.Request, certName string) bool {
+	if oidcAuthInst == nil {
+		return true
+	}
+
+	claims, ok := claimsFromContext(r.Context())
+	if !ok || !oidcAuthInst.isAllowed(claims, certName) {
+		logger.Printf("oidc: subject '%s' denied access to cert '%s'", claims.Subject, certName)
+		sendErrorResponse(w, "not authorized to use this certificate", http.StatusForbidden, nil)
+		return false
+	}
+	return true
+}
+
+// jobCreateReq is the JSON body accepted by POST /jobs as an alternative to
+// a multipart upload, referencing an input PDF already placed in the
+// configured --job-work-dir ahead of time, for batch/bulk use.
+type jobCreateReq struct {
+	CertName string `json:"certName"`
+
+	// InFile is a path relative to --job-work-dir (no absolute paths or
+	// "../" escapes, see jobManager.resolveInFile) naming an input PDF
+	// already placed there.
+	InFile string               `json:"inFile"`
+	Props  *processor.SignProps `json:"props"`
+}
+
+// handleJobCreate handles an async signing job submission, either as a
+// multipart upload (fields "certName", optional "props", file "file") or,
+// for batch/bulk use, a JSON body referencing a file already placed in the
+// job work dir (see jobCreateReq.InFile). It returns the queued job's ID
+// immediately; use GET /jobs/{id} to poll status and GET /jobs/{id}/result
+// to fetch the signed PDF once done.
+func handleJobCreate(w http.ResponseWriter, r *http.Request) {
+	var (
+		certName string
+		props    *processor.SignProps
+		id       string
+		err      error
+	)
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req jobCreateReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendErrorResponse(w, fmt.Sprintf("invalid JSON body: %v", err), http.StatusBadRequest, nil)
+			return
+		}
+		if req.InFile == "" {
+			sendErrorResponse(w, "`inFile` is required", http.StatusBadRequest, nil)
+			return
+		}
+
+		certName, props = req.CertName, req.Props
+		if !jobCertAllowed(w, r, certName) {
+			return
+		}
+
+		inFile, ferr := jobs.resolveInFile(req.InFile)
+		if ferr != nil {
+			sendErrorResponse(w, ferr.Error(), http.StatusBadRequest, nil)
+			return
+		}
+
+		f, ferr := os.Open(inFile)
+		if ferr != nil {
+			sendErrorResponse(w, fmt.Sprintf("error opening `inFile`: %v", ferr), http.StatusBadRequest, nil)
+			return
+		}
+		defer f.Close()
+
+		id, err = jobs.enqueue(certName, subjectFromContext(r.Context()), props, f)
+	} else {
+		certName = r.FormValue("certName")
+		if reqB := []byte(r.FormValue("props")); len(reqB) > 0 {
+			pr, perr := parseProps(reqB)
+			if perr != nil {
+				sendErrorResponse(w, fmt.Sprintf("error reading JSON `props`: %v", perr), http.StatusBadRequest, nil)
+				return
+			}
+			props = &pr
+		}
+
+		if !jobCertAllowed(w, r, certName) {
+			return
+		}
+
+		file, _, ferr := r.FormFile("file")
+		if ferr != nil {
+			sendErrorResponse(w, "Invalid file in the `file` field.", http.StatusBadRequest, nil)
+			return
+		}
+		defer file.Close()
+
+		id, err = jobs.enqueue(certName, subjectFromContext(r.Context()), props, file)
+	}
+
+	if err != nil {
+		logger.Printf("error queueing async job: %v", err)
+		sendErrorResponse(w, fmt.Sprintf("Error queueing job: %v", err), http.StatusInternalServerError, nil)
+		return
+	}
+
+	sendResponse(w, map[string]string{"jobId": id})
+}
+
+// handleJobStatus returns the lifecycle state of an async job queued via
+// POST /jobs.
+func handleJobStatus(w http.ResponseWriter, r *http.Request) {
+	rec, ok := jobs.store.Get(chi.URLParam(r, "id"))
+	if !ok {
+		sendErrorResponse(w, "job not found", http.StatusNotFound, nil)
+		return
+	}
+	if !jobCertAllowed(w, r, rec.CertName) {
+		return
+	}
+	sendResponse(w, rec)
+}
+
+// handleJobResult streams the signed PDF produced by a done async job.
+func handleJobResult(w http.ResponseWriter, r *http.Request) {
+	rec, ok := jobs.store.Get(chi.URLParam(r, "id"))
+	if !ok {
+		sendErrorResponse(w, "job not found", http.StatusNotFound, nil)
+		return
+	}
+	if !jobCertAllowed(w, r, rec.CertName) {
+		return
+	}
+
+	switch rec.Status {
+	case jobDone:
+		f, err := os.Open(rec.resultPath)
+		if err != nil {
+			logger.Printf("error opening job result %s: %v", rec.resultPath, err)
+			sendErrorResponse(w, "error reading job result", http.StatusInternalServerError, nil)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("content-type", "application/pdf")
+		io.Copy(w, f)
+	case jobFailed:
+		sendErrorResponse(w, fmt.Sprintf("job failed: %s", rec.Error), http.StatusUnprocessableEntity, nil)
+	default:
+		sendErrorResponse(w, fmt.Sprintf("job is %s, not done yet", rec.Status), http.StatusConflict, nil)
+	}
+}
+
+// auditLog records a single signing request: who signed (if OIDC auth is
+// enabled), with which certificate, the input file size, how long it took,
+// and the outcome.
+func auditLog(subject, certName string, fileSize int64, elapsed time.Duration, outcome string) {
+	if subject == "" {
+		subject = "-"
+	}
+	logger.Printf("audit: subject=%s cert=%s bytes=%d duration=%s outcome=%s",
+		subject, certName, fileSize, elapsed, outcome)
+}
+
 // sendErrorResponse sends a JSON envelope to the HTTP response.
 func sendResponse(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")